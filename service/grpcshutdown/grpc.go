@@ -0,0 +1,49 @@
+package grpcshutdown
+
+import (
+	"context"
+
+	"google.golang.org/grpc"
+
+	"github.com/sunnydongbowen/shutdown_gracefully/service"
+)
+
+// grpcShutdowner 把 *grpc.Server 适配成 service.Shutdowner，
+// 这样 gRPC 服务也能和 HTTP 服务一样被 App 统一编排进优雅退出流程
+type grpcShutdowner struct {
+	name string
+	srv  *grpc.Server
+}
+
+// NewGRPCShutdowner 包装一个 *grpc.Server，使其满足 service.Shutdowner。
+// name 仅用于日志标识，和 service.NewServer 的 name 参数是一回事
+func NewGRPCShutdowner(name string, srv *grpc.Server) service.Shutdowner {
+	return &grpcShutdowner{name: name, srv: srv}
+}
+
+func (g *grpcShutdowner) Name() string {
+	return g.name
+}
+
+// RejectNew 对 gRPC 来说不需要单独处理：GracefulStop 本身就会先停止接受新连接，
+// 所以这里是个空实现，满足接口即可
+func (g *grpcShutdowner) RejectNew(ctx context.Context) error {
+	return nil
+}
+
+// Shutdown 调用 GracefulStop 等待在途 RPC 结束；如果 ctx 提前超时或被取消，
+// 退化为 Stop() 立即断开剩余连接，而不是无限期等下去
+func (g *grpcShutdowner) Shutdown(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		g.srv.GracefulStop()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		g.srv.Stop()
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,10 @@
+package httpshutdown
+
+import "github.com/sunnydongbowen/shutdown_gracefully/service"
+
+// NewHTTPShutdowner 把 *service.Server 适配成 service.Shutdowner。
+// Server 本身已经实现了 Name/RejectNew/Shutdown（以及可选的 NotReady），
+// 这里只是让调用方在注册多种 Shutdowner（HTTP、gRPC……）时用统一、对称的构造方式
+func NewHTTPShutdowner(s *service.Server) service.Shutdowner {
+	return s
+}
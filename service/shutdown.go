@@ -2,20 +2,69 @@ package service
 
 import (
 	"context"
+	"errors"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 )
 
-var wg sync.WaitGroup
-
 // 典型的 Option 设计模式
 type Option func(*App)
 
+// WithShutdownSignals 自定义触发优雅退出的信号，不传则使用默认的 SIGTERM/SIGINT。
+// 不同平台合适的信号集合不一样（Windows 上没有 SIGTERM），配置化之后测试和嵌入方都可以自己决定
+func WithShutdownSignals(sigs ...os.Signal) Option {
+	return func(app *App) {
+		if len(sigs) == 0 {
+			return
+		}
+		app.shutdownSignals = sigs
+	}
+}
+
+// WithForceQuitFunc 自定义收到第二次信号或者 shutdownTimeout 超时之后的强制退出逻辑，
+// 默认是 os.Exit(1)，测试里可以换成别的，避免真的退出测试进程
+func WithForceQuitFunc(f func()) Option {
+	return func(app *App) {
+		app.forceQuitFunc = f
+	}
+}
+
+// WithPreShutdownDelay 设置在真正拒绝新请求之前的等待时间：先把所有 server 的
+// readiness 置为失败，等待 d 让负载均衡器/Ingress 把这个实例摘掉流量，再翻转
+// reject 标记、开始排空连接。对应 k8s 里 preStop hook 配合 readinessProbe 的做法，
+// 避免 LB 自己的探测/同步间隔期间仍有流量打到已经开始 503 的实例上
+func WithPreShutdownDelay(d time.Duration) Option {
+	return func(app *App) {
+		app.preShutdownDelay = d
+	}
+}
+
+// Shutdowner 是能被 App 统一编排退出的组件。最初 App 只认识 *Server，
+// 但 gRPC server、Kafka/NSQ consumer、后台 worker、DB 连接池其实都有同样的退出诉求：
+// 先拒绝新的输入，再等在途的工作跑完。实现了这个接口就能注册进 App，
+// 和 HTTP 服务享受同一套拒绝/排空/强制超时流程
+type Shutdowner interface {
+	// Name 用于日志里标识是哪个组件
+	Name() string
+	// RejectNew 停止接受新的请求/任务，已经在处理的不受影响
+	RejectNew(ctx context.Context) error
+	// Shutdown 等待正在处理的工作完成、或者 ctx 超时/取消后关闭
+	Shutdown(ctx context.Context) error
+}
+
+// ReadinessNotifier 是一个可选接口。Shutdowner 如果还实现了它，
+// App 会在 preShutdownDelay 阶段先调用 NotReady，把就绪探测切到失败，
+// 再进入真正的 RejectNew/Shutdown 流程
+type ReadinessNotifier interface {
+	NotReady()
+}
+
 // ShutdownCallback 采用 context.Context 来控制超时，而不是用 time.After 是因为
 // - 超时本质上是使用这个回调的人控制的
 // - 我们还希望用户知道，他的回调必须要在一定时间内处理完毕，而且他必须显式处理超时错误
@@ -31,7 +80,7 @@ func WithShutdownCallbacks(cbs ...ShutdownCallback) Option {
 
 // 这里我已经预先定义好了各种可配置字段v App是一个结构体，里面设置了各种字段
 type App struct {
-	servers []*Server
+	shutdowners []Shutdowner
 
 	// 优雅退出整个超时时间，默认30秒，需要我们自己初始化的时候设置
 	shutdownTimeout time.Duration
@@ -45,18 +94,36 @@ type App struct {
 	//
 	cbs []ShutdownCallback
 	//
+
+	// 触发优雅退出的信号集合，默认 SIGTERM/SIGINT
+	shutdownSignals []os.Signal
+
+	// 收到第二个信号或者 shutdownTimeout 超时之后执行的强制退出函数，默认 os.Exit(1)
+	forceQuitFunc func()
+
+	// 翻转 reject 标记、开始排空连接之前的等待时间，默认 0（不等待），
+	// 配合 Server.HandleReadiness 给负载均衡器留出摘除流量的窗口
+	preShutdownDelay time.Duration
+
+	// 保证 shutdown 只真正执行一次：信号触发和调用方主动调用 Shutdown 可能同时发生
+	shutdownOnce sync.Once
+	shutdownErr  error
 }
 
 // NewApp 创建 App 实例，注意设置默认值，同时使用这些选项
-// 传参: sever类型的服务列表 ,Option类型的函数，可以传多个.使用的時候传的是.WithShutdownCallbacks。这个就是返回值为Option类型的函数,并且这个函数的参数cbs类型的
+// 传参: Shutdowner类型的组件列表（*Server 自己就实现了 Shutdowner，
+// 其他类型比如 gRPC server 可以用对应子包里的 NewXXXShutdowner 包一层） ,
+// Option类型的函数，可以传多个.使用的時候传的是.WithShutdownCallbacks。这个就是返回值为Option类型的函数,并且这个函数的参数cbs类型的
 // 返回值
-func NewApp(servers []*Server, opts ...Option) *App {
+func NewApp(shutdowners []Shutdowner, opts ...Option) *App {
 	// 先初始化了前面的几个字段
 	app := &App{
-		servers:         servers, //调用这个函数的人传什么就是什么啊，这个就是给调用的传的，你看参数在里面呢。至于具体的server有哪些结构体,暂时不用关心。
+		shutdowners:     shutdowners, //调用这个函数的人传什么就是什么啊，这个就是给调用的传的，你看参数在里面呢。至于具体是哪种 Shutdowner,暂时不用关心。
 		shutdownTimeout: time.Second * 30,
 		waitTime:        time.Second * 10,
 		cbTimeout:       time.Second * 3,
+		shutdownSignals: []os.Signal{syscall.SIGTERM, syscall.SIGINT},
+		forceQuitFunc:   func() { os.Exit(1) },
 	}
 	// 初始化cbs，cbs是一个关闭前的回调函数，所以这里我们用slice方式进行初始化，因为可能不止一个回调函数
 	//
@@ -66,91 +133,172 @@ func NewApp(servers []*Server, opts ...Option) *App {
 	return app
 }
 
+// RegisterOnShutdown 注册一个退出回调，可以在 NewApp 之后随时追加，
+// 效果上等价于 net/http 里 Server.RegisterOnShutdown 的用法，
+// 不必非要在构造时通过 WithShutdownCallbacks 一次性传完
+func (app *App) RegisterOnShutdown(cb ShutdownCallback) {
+	app.cbs = append(app.cbs, cb)
+}
+
 // StartAndServe 你主要要实现这个方法
-func (app *App) StartAndServe() {
-	for _, s := range app.servers {
-		srv := s
-		go func() {
-			if err := srv.Start(); err != nil {
-				if err == http.ErrServerClosed {
-					log.Printf("服务器%s已关闭", srv.name)
-				} else {
-					log.Printf("服务器%s异常退出", srv.name)
-				}
-			}
-		}()
-	}
+// ctx 由调用者传入：取消它和收到退出信号一样，都会触发优雅退出。
+// 注意：每个组件自己怎么"启动"（*Server 的 ListenAndServe、grpc.Server 的 Serve、
+// 一个消费者的拉取循环……）五花八门，不适合统一抽象，所以请在调用 StartAndServe 之前
+// 自己把这些组件跑起来；App 这里只负责监听退出信号、编排所有已注册 Shutdowner 的退出
+func (app *App) StartAndServe(ctx context.Context) {
 	// 从这里开始优雅退出监听系统信号，强制退出以及超时强制退出。
 	// 优雅退出的具体步骤在 shutdown 里面实现
 	// 所以你需要在这里恰当的位置，调用 shutdown
-	ch := make(chan os.Signal, 1) // 定义一个信号类型的channel
-	// 定义监听的信号
-	signals := []os.Signal{syscall.SIGTERM, syscall.SIGINT} // 定义ctr+c和kill信号
-	signal.Notify(ch, signals...)                           //  监听信号
+	ch := make(chan os.Signal, 1)             // 定义一个信号类型的channel
+	signal.Notify(ch, app.shutdownSignals...) // 监听可配置的信号集合
 
-	//ctx, cancel := context.WithTimeout(ctx)
 	select {
 	case <-ch:
-		go func() {
-			select {
-			case <-ch:
-				log.Printf("强制退出")
-				os.Exit(1)
-			case <-time.After(app.shutdownTimeout):
-				log.Printf("超时强制退出")
-				os.Exit(1)
-			}
-		}()
-		// app。shutdown
-		app.shutdown()
+		log.Println("收到退出信号，开始优雅退出")
+	case <-ctx.Done():
+		log.Println("外部 context 被取消，开始优雅退出")
+		// ctx 本身就是这次触发退出的那个已经失效的 context，不能继续原样往下传：
+		// RejectNew、preShutdownDelay、drain 等阶段都需要一个没有提前被取消的 context，
+		// 在这里统一换掉，而不是指望 shutdown 内部每个用到 ctx 的地方各自小心
+		ctx = context.Background()
 	}
-	//if 收到新信号 {
-	//	app.shutdown()
-	//}
+
+	// shutdownDone 在优雅退出流程跑完之后被 cancel，用来告诉下面这个强制退出的
+	// goroutine"已经不需要再等了"。没有它的话，一旦配了个空操作的 forceQuitFunc
+	// （这个包自己的测试就是这么用的），这个 goroutine 会一直阻塞到 shutdownTimeout、
+	// 甚至永远等不到第二个信号，白白泄漏一个 goroutine
+	shutdownDone, markShutdownDone := context.WithCancel(context.Background())
+	defer markShutdownDone()
+
+	// 收到第二次信号，或者整体优雅退出超过 shutdownTimeout 还没完成，就强制退出
+	go func() {
+		select {
+		case <-ch:
+			log.Printf("强制退出")
+			app.forceQuitFunc()
+		case <-time.After(app.shutdownTimeout):
+			log.Printf("超时强制退出")
+			app.forceQuitFunc()
+		case <-shutdownDone.Done():
+		}
+	}()
+
+	// app。shutdown
+	if err := app.Shutdown(ctx); err != nil {
+		log.Printf("优雅退出未完全成功: %v", err)
+	}
+}
+
+// Shutdown 触发优雅退出，返回各阶段遇到的聚合错误。既可以像这个包内部一样
+// 由信号处理器调用，也可以由调用方在别的地方主动调用（比如收到业务层的下线指令），
+// 用 sync.Once 保证不管触发几次，真正的退出逻辑只跑一遍
+func (app *App) Shutdown(ctx context.Context) error {
+	app.shutdownOnce.Do(func() {
+		app.shutdownErr = app.shutdown(ctx)
+	})
+	return app.shutdownErr
 }
 
 // shutdown 你要设计这里面的执行步骤。
-func (app *App) shutdown() {
-	log.Println("开始关闭应用，停止接收新请求")
-	// 你需要在这里让所有的 server 拒绝新请求
-	// 停止接收新请求
-	for _, server := range app.servers {
-		server.rejectReq() // 拒绝新请求
+func (app *App) shutdown(ctx context.Context) error {
+	log.Println("开始关闭应用，先标记 readiness 为未就绪")
+	// 在拒绝新请求之前，先让实现了 ReadinessNotifier 的组件把就绪探测切到失败，
+	// 给负载均衡器一个摘除流量的窗口；不支持 readiness 概念的组件（比如后台 worker）直接跳过
+	for _, sd := range app.shutdowners {
+		if rn, ok := sd.(ReadinessNotifier); ok {
+			rn.NotReady()
+		}
+	}
+	if app.preShutdownDelay > 0 {
+		log.Printf("等待 %s 让负载均衡器完成摘除", app.preShutdownDelay)
+		// timer 本身不以 ctx 为父 context 派生：ctx 在 StartAndServe 里已经被
+		// 归一化成一个没有提前取消的 context了，但 App.Shutdown(ctx) 也可以被
+		// 调用方直接带着自己的 ctx 调用，所以这里仍然 select 一下 ctx.Done()，
+		// 让调用方可以用自己的 ctx 提前结束这个等待，而不是死等 preShutdownDelay
+		timer := time.NewTimer(app.preShutdownDelay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+		}
+	}
+
+	log.Println("停止接收新请求")
+	// 让所有注册的 Shutdowner 拒绝新的请求/任务
+	for _, sd := range app.shutdowners {
+		if err := sd.RejectNew(ctx); err != nil {
+			log.Printf("组件%s拒绝新请求失败: %v\n", sd.Name(), err)
+		}
 	}
 
 	log.Println("等待正在执行请求完结")
-	// 在这里等待一段时间
-	time.Sleep(app.waitTime)
-
-	log.Println("开始关闭服务器")
-	// 并发关闭服务器，同时要注意协调所有的 server 都关闭之后才能步入下一个阶段
-	wg.Add(len(app.servers))
-	for _, srv := range app.servers {
-		srvCp := srv
+	// 用 app.waitTime 派生出一个带超时的 context，交给 Shutdown 去轮询空闲连接，
+	// 而不是死等 waitTime 这么久 —— 这样卡住的请求不会拖垮整个退出流程。
+	// 故意以 context.Background() 为父 context，不用传进来的 ctx：调用方完全可以
+	// 直接带着一个已经取消的 ctx 调用 App.Shutdown（比如想跳过 waitTime 立即强制关闭），
+	// 但这不应该影响这里"drain 阶段至少有 waitTime 预算"的保证
+	drainCtx, cancel := context.WithTimeout(context.Background(), app.waitTime)
+	defer cancel()
+
+	log.Println("开始关闭各组件")
+	// 并发关闭每个 Shutdowner，同时要注意协调所有组件都关闭之后才能步入下一个阶段。
+	// 用函数局部的 WaitGroup 而不是包级变量，这样多个 App 实例（以及重复的测试）
+	// 不会互相干扰彼此的计数
+	var sdWg sync.WaitGroup
+	sdWg.Add(len(app.shutdowners))
+	errCh := make(chan error, len(app.shutdowners))
+	for _, sd := range app.shutdowners {
+		sdCp := sd
 		go func() {
-			if err := srvCp.stop(); err != nil {
-				log.Printf("关闭服务失败%s\n")
+			defer sdWg.Done()
+			if err := sdCp.Shutdown(drainCtx); err != nil {
+				log.Printf("关闭组件%s失败: %v\n", sdCp.Name(), err)
+				errCh <- err
 			}
-			wg.Done()
 		}()
 	}
-	wg.Wait()
+	sdWg.Wait()
+	close(errCh)
+	var errs []error
+	for err := range errCh {
+		errs = append(errs, err)
+	}
 
 	log.Println("开始执行自定义回调")
-	// 并发执行回调，要注意协调所有的回调都执行完才会步入下一个阶段
-	wg.Add(len(app.cbs))
+	// 用一个独立的 WaitGroup 等待每个回调执行完毕或者到达各自的 cbTimeout，而不是 fire-and-forget，
+	// 否则 app.close() 可能在回调跑完之前就执行了；超时的回调不再等待，它的 goroutine 可能仍在运行
+	var cbWg sync.WaitGroup
+	cbWg.Add(len(app.cbs))
+	cbErrCh := make(chan error, len(app.cbs))
 	for _, cb := range app.cbs {
 		c := cb
 		go func() {
-			ctx, cancel := context.WithTimeout(context.Background(), app.cbTimeout)
-			ctx.Done()
-			c(ctx)
-			cancel()
+			defer cbWg.Done()
+			cbCtx, cancel := context.WithTimeout(context.Background(), app.cbTimeout)
+			defer cancel()
+			done := make(chan struct{})
+			go func() {
+				c(cbCtx)
+				close(done)
+			}()
+			select {
+			case <-done:
+			case <-cbCtx.Done():
+				log.Printf("自定义回调超时未完成: %v", cbCtx.Err())
+				cbErrCh <- cbCtx.Err()
+			}
 		}()
 	}
+	cbWg.Wait()
+	close(cbErrCh)
+	for err := range cbErrCh {
+		errs = append(errs, err)
+	}
+
 	// 释放资源
 	log.Println("开始释放资源")
 	app.close()
+	return errors.Join(errs...)
 }
 
 func (app *App) close() {
@@ -169,6 +317,9 @@ type Server struct {
 	srv  *http.Server
 	name string
 	mux  *serverMux
+
+	// 就绪状态，配合 HandleReadiness 暴露给负载均衡器做探测
+	ready atomic.Bool
 }
 
 // 拒绝新请求
@@ -183,7 +334,7 @@ func (s *serverMux) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 func NewServer(name string, addr string) *Server {
 	mux := &serverMux{ServeMux: http.NewServeMux()}
-	return &Server{
+	s := &Server{
 		name: name,
 		mux:  mux,
 		srv: &http.Server{
@@ -191,21 +342,52 @@ func NewServer(name string, addr string) *Server {
 			Handler: mux,
 		},
 	}
+	s.ready.Store(true)
+	return s
 }
 
 func (s *Server) Handle(pattern string, handler http.Handler) {
 	s.mux.Handle(pattern, handler)
 }
 
+// HandleReadiness 注册一个只读的就绪探测接口，配合 k8s 的 readinessProbe 使用：
+// 优雅退出开始时我们先把这里切到失败，等 Service/Ingress 把这个实例摘掉之后，
+// 才真正开始拒绝新请求、排空连接，避免摘除同步间隔内仍有新流量打进来
+func (s *Server) HandleReadiness(pattern string) {
+	s.mux.Handle(pattern, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !s.ready.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			_, _ = w.Write([]byte("not ready"))
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte("ok"))
+	}))
+}
+
+// NotReady 将就绪状态置为失败，优雅退出时在拒绝新请求之前调用。
+// 实现了 ReadinessNotifier，App 会在 preShutdownDelay 阶段自动调用
+func (s *Server) NotReady() {
+	s.ready.Store(false)
+}
+
 func (s *Server) Start() error {
 	return s.srv.ListenAndServe()
 }
 
-func (s *Server) rejectReq() {
+// Name 实现 Shutdowner
+func (s *Server) Name() string {
+	return s.name
+}
+
+// RejectNew 实现 Shutdowner，让这个 server 开始对新请求返回 503
+func (s *Server) RejectNew(ctx context.Context) error {
 	s.mux.reject = true
+	return nil
 }
 
-func (s *Server) stop() error {
+// Shutdown 实现 Shutdowner，委托给 http.Server.Shutdown 去等待在途请求结束
+func (s *Server) Shutdown(ctx context.Context) error {
 	log.Printf("服务器%s关闭中", s.name)
-	return s.srv.Shutdown(context.Background())
+	return s.srv.Shutdown(ctx)
 }
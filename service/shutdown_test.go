@@ -0,0 +1,117 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeShutdowner 是测试里用的假 Shutdowner，可以配置 RejectNew/Shutdown 的
+// 返回值，以及 Shutdown 阻塞多久，用来模拟慢组件
+type fakeShutdowner struct {
+	name string
+
+	rejectErr     error
+	shutdownErr   error
+	shutdownDelay time.Duration
+
+	rejectCalls   int32
+	shutdownCalls int32
+}
+
+func (f *fakeShutdowner) Name() string { return f.name }
+
+func (f *fakeShutdowner) RejectNew(ctx context.Context) error {
+	atomic.AddInt32(&f.rejectCalls, 1)
+	return f.rejectErr
+}
+
+func (f *fakeShutdowner) Shutdown(ctx context.Context) error {
+	atomic.AddInt32(&f.shutdownCalls, 1)
+	if f.shutdownDelay > 0 {
+		select {
+		case <-time.After(f.shutdownDelay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return f.shutdownErr
+}
+
+// TestApp_Shutdown_Idempotent 验证 Shutdown 被并发调用多次时，真正的退出逻辑
+// 只会执行一次（sync.Once 守护），而不是每次调用都重新拒绝请求、重新关闭组件
+func TestApp_Shutdown_Idempotent(t *testing.T) {
+	sd := &fakeShutdowner{name: "fake"}
+	app := NewApp([]Shutdowner{sd}, WithForceQuitFunc(func() {}))
+
+	var wg sync.WaitGroup
+	wg.Add(3)
+	for i := 0; i < 3; i++ {
+		go func() {
+			defer wg.Done()
+			_ = app.Shutdown(context.Background())
+		}()
+	}
+	wg.Wait()
+
+	if calls := atomic.LoadInt32(&sd.rejectCalls); calls != 1 {
+		t.Fatalf("RejectNew 应该只被调用一次，实际调用了 %d 次", calls)
+	}
+	if calls := atomic.LoadInt32(&sd.shutdownCalls); calls != 1 {
+		t.Fatalf("Shutdown 应该只被调用一次，实际调用了 %d 次", calls)
+	}
+}
+
+// TestApp_Shutdown_AggregatesErrors 验证多个组件各自返回错误时，
+// App.Shutdown 用 errors.Join 把它们都聚合返回，而不是只保留第一个
+func TestApp_Shutdown_AggregatesErrors(t *testing.T) {
+	err1 := errors.New("server1 shutdown failed")
+	err2 := errors.New("server2 shutdown failed")
+	sd1 := &fakeShutdowner{name: "server1", shutdownErr: err1}
+	sd2 := &fakeShutdowner{name: "server2", shutdownErr: err2}
+
+	app := NewApp([]Shutdowner{sd1, sd2}, WithForceQuitFunc(func() {}))
+
+	err := app.Shutdown(context.Background())
+	if err == nil {
+		t.Fatal("期望聚合错误，实际返回 nil")
+	}
+	if !errors.Is(err, err1) {
+		t.Errorf("聚合错误里缺少 err1: %v", err)
+	}
+	if !errors.Is(err, err2) {
+		t.Errorf("聚合错误里缺少 err2: %v", err)
+	}
+}
+
+// TestApp_Shutdown_DrainTimeout 验证 drain 阶段确实按 app.waitTime 来限时等待，
+// 即使传进来的 ctx 在调用前就已经被取消——这是 chunk0-3 修复的那个问题：
+// drainCtx 不能以外部已取消的 ctx 为父 context 派生，否则会立刻到期
+func TestApp_Shutdown_DrainTimeout(t *testing.T) {
+	// shutdownDelay 故意设得比 waitTime 大得多，这样只要 drain 阶段真的按 waitTime
+	// 限时返回，总耗时就会远小于 shutdownDelay；app.close() 里固定 1 秒的 time.Sleep
+	// 也会算进总耗时，所以上界留够余量
+	slow := &fakeShutdowner{name: "slow", shutdownDelay: 5 * time.Second}
+	app := NewApp([]Shutdowner{slow}, WithForceQuitFunc(func() {}))
+	app.waitTime = 50 * time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel() // 模拟调用方带着一个已经取消的 ctx 直接调用 App.Shutdown 的场景
+
+	start := time.Now()
+	err := app.Shutdown(ctx)
+	elapsed := time.Since(start)
+
+	if elapsed < app.waitTime {
+		t.Fatalf("drain 阶段结束得太快（%s），没有真正等待 waitTime=%s", elapsed, app.waitTime)
+	}
+	if elapsed >= 2*time.Second {
+		t.Fatalf("drain 阶段耗时 %s，看起来没有在 waitTime 超时后就返回，而是等了慢组件的全部耗时", elapsed)
+	}
+	if err == nil {
+		t.Fatal("组件没在 waitTime 内关闭完，期望返回超时错误")
+	}
+}